@@ -0,0 +1,153 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	ociTypes "github.com/containers/image/v5/types"
+	sifassemblers "github.com/hpcng/singularity/internal/pkg/build/assemblers"
+	"github.com/hpcng/singularity/pkg/build/assemblers"
+	buildtypes "github.com/hpcng/singularity/pkg/build/types"
+	"github.com/hpcng/singularity/pkg/sylog"
+	"github.com/spf13/cobra"
+)
+
+var (
+	buildRootfsFlag string
+	buildOCIRefFlag string
+)
+
+// BuildCmd builds a SIF image at the given path from one of the sources
+// selected by its flags: an already populated rootfs directory
+// (--rootfs), an OCI image reference (--oci-ref), or one rootfs per
+// architecture for a multi-arch fat SIF (--fat-arch, repeatable).
+var BuildCmd = &cobra.Command{
+	Use:   "build [options] <sif path>",
+	Short: "Build a SIF image",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		imagePath := args[0]
+
+		compression, level, err := parseCompressionFlag(buildCompressionFlag)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case isConfidentialBuild():
+			if buildRootfsFlag == "" {
+				return fmt.Errorf("--format=%s requires --rootfs", buildFormatConfidential)
+			}
+			targets, err := confidentialAttestationTargets()
+			if err != nil {
+				return err
+			}
+			bundleSize, err := dirSize(buildRootfsFlag)
+			if err != nil {
+				return fmt.Errorf("while sizing %s: %v", buildRootfsFlag, err)
+			}
+			a := &assemblers.ConfidentialSIFAssembler{}
+			if err := a.Assemble(buildRootfsFlag, imagePath, bundleSize, targets); err != nil {
+				return fmt.Errorf("while building %s: %v", imagePath, err)
+			}
+
+		case len(buildFatArchFlag) > 0:
+			inputs, err := parseFatArchFlag(buildFatArchFlag)
+			if err != nil {
+				return err
+			}
+			b, err := rootfsBundle("")
+			if err != nil {
+				return err
+			}
+			a := &assemblers.FatSIFAssembler{
+				Compression:      compression,
+				CompressionLevel: level,
+			}
+			if err := a.Assemble(inputs, b, imagePath); err != nil {
+				return fmt.Errorf("while building %s: %v", imagePath, err)
+			}
+
+		case buildOCIRefFlag != "":
+			a := &assemblers.OCISIFAssembler{
+				Compression:      compression,
+				CompressionLevel: level,
+			}
+			if err := a.Assemble(cmd.Context(), buildOCIRefFlag, imagePath, &ociTypes.SystemContext{}); err != nil {
+				return fmt.Errorf("while building %s from %s: %v", imagePath, buildOCIRefFlag, err)
+			}
+
+		case buildRootfsFlag != "":
+			b, err := rootfsBundle(buildRootfsFlag)
+			if err != nil {
+				return err
+			}
+			a := &sifassemblers.SIFAssembler{
+				Compression:      compression,
+				CompressionLevel: level,
+			}
+			if err := a.Assemble(b, imagePath); err != nil {
+				return fmt.Errorf("while building %s: %v", imagePath, err)
+			}
+
+		default:
+			return fmt.Errorf("--rootfs, --oci-ref, or --fat-arch is required")
+		}
+
+		sylog.Infof("Built %s", imagePath)
+		return nil
+	},
+}
+
+func init() {
+	BuildCmd.Flags().StringVar(&buildRootfsFlag, "rootfs", "", "path to an already populated rootfs directory to build from")
+	BuildCmd.Flags().StringVar(&buildOCIRefFlag, "oci-ref", "", "OCI image reference to build from (docker://, oci://, ...)")
+	BuildCmd.Flags().StringVar(&buildCompressionFlag, "compression", "", "squashfs compression codec and level, as <codec>[:<level>] (default gzip)")
+	BuildCmd.Flags().StringArrayVar(&buildFatArchFlag, "fat-arch", nil, "arch=rootfs pair for a multi-arch fat SIF; repeat once per architecture")
+
+	RootCmd.AddCommand(BuildCmd)
+}
+
+// rootfsBundle builds the types.Bundle SIFAssembler and FatSIFAssembler
+// expect, pointing it at an already populated rootfs directory. There is no
+// definition-file conveyor in play here, so Recipe and JSONObjects are left
+// at their zero value: this only supports building straight from a rootfs,
+// not from a build definition.
+func rootfsBundle(rootfsPath string) (*buildtypes.Bundle, error) {
+	tmpDir, err := ioutil.TempDir("", "sif-build-")
+	if err != nil {
+		return nil, fmt.Errorf("while creating build temp dir: %v", err)
+	}
+
+	return &buildtypes.Bundle{
+		RootfsPath: rootfsPath,
+		TmpDir:     tmpDir,
+	}, nil
+}
+
+// dirSize sums the apparent size of every regular file under root, for use
+// as ConfidentialSIFAssembler's bundleSize: the size of the rootfs it's
+// about to copy into a LUKS2-encrypted ext4 image, before that assembler
+// applies its own slack/overhead margin on top.
+func dirSize(root string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(root, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size, err
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hpcng/singularity/pkg/image/packer"
+)
+
+// buildCompressionFlag is the raw --compression value, in "<codec>[:<level>]"
+// form (e.g. "zstd", "zstd:19", "xz:9"). It's kept as a string rather than a
+// packer.Compression so cobra can register it as a plain flag without a
+// custom pflag.Value implementation.
+var buildCompressionFlag string
+
+// parseCompressionFlag splits a --compression value into the packer codec
+// and compression level it selects. An empty value means the SIFAssembler
+// default (gzip, level unset).
+func parseCompressionFlag(value string) (packer.Compression, int, error) {
+	if value == "" {
+		return packer.CompressionGzip, 0, nil
+	}
+
+	parts := strings.SplitN(value, ":", 2)
+	codec := parts[0]
+
+	var level int
+	if len(parts) == 2 {
+		l, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid compression level %q: %v", parts[1], err)
+		}
+		level = l
+	}
+
+	switch strings.ToLower(codec) {
+	case "gzip":
+		return packer.CompressionGzip, level, nil
+	case "zstd":
+		return packer.CompressionZstd, level, nil
+	case "lz4":
+		return packer.CompressionLz4, level, nil
+	case "xz":
+		return packer.CompressionXz, level, nil
+	case "none":
+		return packer.CompressionNone, level, nil
+	default:
+		return 0, 0, fmt.Errorf("unknown compression codec %q", codec)
+	}
+}
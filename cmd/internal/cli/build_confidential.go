@@ -0,0 +1,64 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hpcng/singularity/pkg/build/assemblers"
+	"github.com/hpcng/singularity/pkg/util/cryptkey"
+)
+
+// Confidential-workload build flags, layered onto the existing "build"
+// command alongside its default --format=sif.
+var (
+	buildFormatFlag            string
+	buildWorkloadIDFlag        string
+	buildAttestationURLFlag    string
+	buildTeeTypeFlag           string
+	buildMeasurementPolicyFlag string
+	buildWorkloadPEMPathFlag   string
+)
+
+const buildFormatConfidential = "cw"
+
+func init() {
+	BuildCmd.Flags().StringVar(&buildFormatFlag, "format", "sif", "image format to build: sif, or cw for a confidential-workload SIF")
+	BuildCmd.Flags().StringVar(&buildWorkloadIDFlag, "workload-id", "", "workload identifier, required with --format=cw")
+	BuildCmd.Flags().StringVar(&buildAttestationURLFlag, "attestation-url", "", "attestation service URL, for --format=cw")
+	BuildCmd.Flags().StringVar(&buildTeeTypeFlag, "tee-type", "", "confidential-computing TEE type (e.g. sev-snp, tdx), for --format=cw")
+	BuildCmd.Flags().StringVar(&buildMeasurementPolicyFlag, "measurement-policy", "", "guest measurement policy, for --format=cw")
+	BuildCmd.Flags().StringVar(&buildWorkloadPEMPathFlag, "workload-pem-path", "", "path to the PEM-encoded RSA public key that wraps the disk passphrase for the workload, required with --format=cw")
+}
+
+// confidentialAttestationTargets builds the single AttestationTarget
+// implied by the --workload-id/--attestation-url/--tee-type/
+// --measurement-policy/--workload-pem-path flags, for use when
+// --format=cw is set. Only one target can be expressed through flags
+// today; a config-file form for multiple targets is left for a follow-up.
+func confidentialAttestationTargets() ([]assemblers.AttestationTarget, error) {
+	if buildWorkloadIDFlag == "" {
+		return nil, fmt.Errorf("--format=%s requires --workload-id", buildFormatConfidential)
+	}
+	if buildWorkloadPEMPathFlag == "" {
+		return nil, fmt.Errorf("--format=%s requires --workload-pem-path", buildFormatConfidential)
+	}
+
+	return []assemblers.AttestationTarget{{
+		WorkloadID:        buildWorkloadIDFlag,
+		AttestationURL:    buildAttestationURLFlag,
+		TeeType:           buildTeeTypeFlag,
+		MeasurementPolicy: buildMeasurementPolicyFlag,
+		KeyInfo:           cryptkey.KeyInfo{Format: cryptkey.PEM, Path: buildWorkloadPEMPathFlag},
+	}}, nil
+}
+
+// isConfidentialBuild reports whether --format requested a confidential
+// workload SIF.
+func isConfidentialBuild() bool {
+	return strings.EqualFold(buildFormatFlag, buildFormatConfidential)
+}
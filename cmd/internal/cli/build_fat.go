@@ -0,0 +1,34 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hpcng/singularity/pkg/build/assemblers"
+)
+
+// buildFatArchFlag holds the raw --fat-arch values, each in "<arch>=<rootfs
+// path>" form (e.g. "amd64=/tmp/rootfs-amd64"). Repeating the flag adds one
+// architecture to the fat SIF being built.
+var buildFatArchFlag []string
+
+// parseFatArchFlag turns the raw --fat-arch values into the ArchRootfs
+// slice FatSIFAssembler.Assemble expects.
+func parseFatArchFlag(values []string) ([]assemblers.ArchRootfs, error) {
+	inputs := make([]assemblers.ArchRootfs, 0, len(values))
+
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid --fat-arch value %q, want <arch>=<rootfs path>", value)
+		}
+		inputs = append(inputs, assemblers.ArchRootfs{Arch: parts[0], RootfsPath: parts[1]})
+	}
+
+	return inputs, nil
+}
@@ -0,0 +1,24 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cli
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// RootCmd is the top-level "singularity" command that cmd/singularity's
+// main package executes. Subcommands register themselves onto it from
+// their own init(), alongside the command they belong under.
+var RootCmd = &cobra.Command{
+	Use:           "singularity",
+	Short:         "App Container Engine",
+	SilenceErrors: true,
+	SilenceUsage:  true,
+}
+
+func init() {
+	RootCmd.AddCommand(SifCmd)
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cli
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// SifCmd is the parent "sif" command, gathering the subcommands that
+// operate directly on SIF files rather than building or running them.
+var SifCmd = &cobra.Command{
+	Use:   "sif",
+	Short: "Manipulate SIF files",
+}
+
+// SifKeyCmd is the parent "sif key" command, gathering SIF encryption-key
+// management subcommands.
+var SifKeyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage SIF encryption keys",
+}
+
+func init() {
+	SifCmd.AddCommand(SifKeyCmd)
+	SifCmd.AddCommand(SifEncryptCmd)
+	SifKeyCmd.AddCommand(SifKeyRotateCmd)
+	SifCmd.AddCommand(SifOciToSifCmd)
+	SifCmd.AddCommand(SifToOciCmd)
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/containers/image/v5/types"
+	"github.com/hpcng/singularity/pkg/build/assemblers"
+	"github.com/hpcng/singularity/pkg/sylog"
+	"github.com/spf13/cobra"
+)
+
+// SifOciToSifCmd builds a SIF directly from an OCI image reference, without
+// unpacking an intermediate rootfs, using OCISIFAssembler.
+var SifOciToSifCmd = &cobra.Command{
+	Use:   "oci2sif <image ref> <sif path>",
+	Short: "Build a SIF directly from an OCI image reference",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := &assemblers.OCISIFAssembler{}
+
+		if err := a.Assemble(cmd.Context(), args[0], args[1], &types.SystemContext{}); err != nil {
+			return fmt.Errorf("while building %s from %s: %v", args[1], args[0], err)
+		}
+
+		sylog.Infof("Built %s from %s", args[1], args[0])
+		return nil
+	},
+}
+
+// SifToOciCmd reassembles an OCI image from a SIF built by oci2sif.
+var SifToOciCmd = &cobra.Command{
+	Use:   "sif2oci <sif path> <image ref>",
+	Short: "Reassemble an OCI image from a SIF built by oci2sif",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a := &assemblers.OCISIFAssembler{}
+
+		if err := a.ToOCI(cmd.Context(), args[0], args[1]); err != nil {
+			return fmt.Errorf("while converting %s to %s: %v", args[0], args[1], err)
+		}
+
+		sylog.Infof("Wrote %s from %s", args[1], args[0])
+		return nil
+	},
+}
@@ -6,8 +6,10 @@
 package assemblers
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"regexp"
@@ -15,34 +17,47 @@ import (
 	"sort"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/hpcng/sif/pkg/sif"
 	"github.com/hpcng/singularity/internal/pkg/util/crypt"
 	"github.com/hpcng/singularity/internal/pkg/util/machine"
 	"github.com/hpcng/singularity/pkg/build/types"
+	"github.com/hpcng/singularity/pkg/image"
 	"github.com/hpcng/singularity/pkg/image/packer"
+	"github.com/hpcng/singularity/pkg/image/unpacker"
 	"github.com/hpcng/singularity/pkg/sylog"
-	"github.com/hpcng/singularity/pkg/util/cryptkey"
 	uuid "github.com/satori/go.uuid"
 )
 
 // SIFAssembler doesn't store anything.
 type SIFAssembler struct {
-	GzipFlag        bool
-	MksquashfsProcs uint
-	MksquashfsMem   string
-	MksquashfsPath  string
+	// GzipFlag is deprecated: set Compression to packer.CompressionGzip
+	// instead. It is kept only so existing callers that still set it
+	// continue to get gzip compression.
+	GzipFlag             bool
+	Compression          packer.Compression
+	CompressionLevel     int
+	CompressionBlockSize uint
+	MksquashfsProcs      uint
+	MksquashfsMem        string
+	MksquashfsPath       string
+
+	// Reproducible, when set, makes Assemble produce a bit-for-bit
+	// identical SIF across runs from an identical bundle: the SIF ID is
+	// derived deterministically instead of randomly generated, and
+	// mksquashfs is told to normalize timestamps instead of inheriting
+	// them from disk.
+	Reproducible bool
+	// SourceDateEpoch pins the timestamp mksquashfs uses when Reproducible
+	// is set. The zero value means the Unix epoch.
+	SourceDateEpoch time.Time
 }
 
-type encryptionOptions struct {
-	keyInfo   cryptkey.KeyInfo
-	plaintext []byte
-}
-
-func createSIF(path string, b *types.Bundle, squashfile string, encOpts *encryptionOptions, arch string) (err error) {
+func createSIF(path string, b *types.Bundle, squashfile string, arch string, reproducible bool) (err error) {
 	definition := b.Recipe.Raw
 
-	id, err := uuid.NewV4()
+	id, err := sifID(definition, b.JSONObjects, squashfile, reproducible)
 	if err != nil {
 		return fmt.Errorf("sif id generation failed: %v", err)
 	}
@@ -114,13 +129,7 @@ func createSIF(path string, b *types.Bundle, squashfile string, encOpts *encrypt
 	parinput.Fp = fp
 	parinput.Size = fi.Size()
 
-	sifType := sif.FsSquash
-
-	if encOpts != nil {
-		sifType = sif.FsEncryptedSquashfs
-	}
-
-	err = parinput.SetPartExtra(sifType, sif.PartPrimSys, sif.GetSIFArch(arch))
+	err = parinput.SetPartExtra(sif.FsSquash, sif.PartPrimSys, sif.GetSIFArch(arch))
 	if err != nil {
 		return
 	}
@@ -128,32 +137,6 @@ func createSIF(path string, b *types.Bundle, squashfile string, encOpts *encrypt
 	// add this descriptor input element to the list
 	cinfo.InputDescr = append(cinfo.InputDescr, parinput)
 
-	if encOpts != nil {
-		data, err := cryptkey.EncryptKey(encOpts.keyInfo, encOpts.plaintext)
-		if err != nil {
-			return fmt.Errorf("while encrypting filesystem key: %s", err)
-		}
-
-		if data != nil {
-			syspartID := uint32(len(cinfo.InputDescr))
-			part := sif.DescriptorInput{
-				Datatype: sif.DataCryptoMessage,
-				Groupid:  sif.DescrDefaultGroup,
-				Link:     syspartID,
-				Data:     data,
-				Size:     int64(len(data)),
-			}
-
-			// extra data needed for the creation of a signature descriptor
-			err := part.SetCryptoMsgExtra(sif.FormatPEM, sif.MessageRSAOAEP)
-			if err != nil {
-				return err
-			}
-
-			cinfo.InputDescr = append(cinfo.InputDescr, part)
-		}
-	}
-
 	// remove anything that may exist at the build destination at last moment
 	os.RemoveAll(path)
 
@@ -198,16 +181,35 @@ func (a *SIFAssembler) Assemble(b *types.Bundle, path string) error {
 	if syscall.Getuid() != 0 {
 		flags = append(flags, "-all-root")
 	}
-	// specify compression if needed
+	// specify compression, honoring the deprecated GzipFlag if set
+	comp := a.Compression
 	if a.GzipFlag {
-		flags = append(flags, "-comp", "gzip")
+		comp = packer.CompressionGzip
+	}
+	if err := s.ProbeCompression(comp); err != nil {
+		return fmt.Errorf("while probing mksquashfs compression support: %v", err)
 	}
+	compFlags, err := s.CompressionArgs(comp, a.CompressionLevel, a.CompressionBlockSize)
+	if err != nil {
+		return fmt.Errorf("while building compression arguments: %v", err)
+	}
+	flags = append(flags, compFlags...)
 	if a.MksquashfsMem != "" {
 		flags = append(flags, "-mem", a.MksquashfsMem)
 	}
 	if a.MksquashfsProcs != 0 {
 		flags = append(flags, "-processors", fmt.Sprint(a.MksquashfsProcs))
 	}
+	if a.Reproducible {
+		epoch := "0"
+		if !a.SourceDateEpoch.IsZero() {
+			epoch = fmt.Sprint(a.SourceDateEpoch.Unix())
+		}
+		flags = append(flags, "-fstime", epoch, "-mkfs-time", epoch, "-no-exports")
+		if syscall.Getuid() == 0 {
+			flags = append(flags, "-all-root")
+		}
+	}
 	arch := machine.ArchFromContainer(b.RootfsPath)
 	if arch == "" {
 		sylog.Infof("Architecture not recognized, use native")
@@ -219,39 +221,127 @@ func (a *SIFAssembler) Assemble(b *types.Bundle, path string) error {
 		return fmt.Errorf("while creating squashfs: %v", err)
 	}
 
-	var encOpts *encryptionOptions
+	if err := createSIF(path, b, fsPath, arch, a.Reproducible); err != nil {
+		return fmt.Errorf("while creating SIF: %v", err)
+	}
+
+	if a.Reproducible {
+		if err := zeroDescriptorPadding(path); err != nil {
+			return fmt.Errorf("while zeroing SIF padding: %v", err)
+		}
+	}
 
 	if b.Opts.EncryptionKeyInfo != nil {
-		plaintext, err := cryptkey.NewPlaintextKey(*b.Opts.EncryptionKeyInfo)
-		if err != nil {
-			return fmt.Errorf("unable to obtain encryption key: %+v", err)
+		enc := &crypt.SIFEncryptor{}
+		if err := enc.EncryptSIF(path, *b.Opts.EncryptionKeyInfo); err != nil {
+			return fmt.Errorf("while encrypting SIF: %v", err)
 		}
+	}
 
-		// A dm-crypt device needs to be created with squashfs
-		cryptDev := &crypt.Device{}
+	return nil
+}
 
-		// TODO (schebro): Fix #3876
-		// Detach the following code from the squashfs creation. SIF can be
-		// created first and encrypted after. This gives the flexibility to
-		// encrypt an existing SIF
-		loopPath, err := cryptDev.EncryptFilesystem(fsPath, plaintext)
+// ExtractSandbox extracts the primary system partition of the SIF at path
+// into the sandbox directory dest, using a pure-Go squashfs reader instead
+// of shelling out to unsquashfs. It is the inverse of Assemble, and is what
+// fakeroot/user-namespace sandbox builds use to turn a SIF back into a
+// rootfs.
+func ExtractSandbox(path, dest string, allowDevices bool) error {
+	fimg, err := sif.LoadContainer(path, true)
+	if err != nil {
+		return fmt.Errorf("while loading SIF %s: %s", path, err)
+	}
+	defer fimg.UnloadContainer()
+
+	// A fat SIF can carry more than one PartPrimSys descriptor, one per
+	// architecture, so GetPartPrimSys's "first match" isn't reliable here;
+	// SelectArchPartition picks the one matching the running architecture.
+	// Fall back to GetPartPrimSys for a plain, single-arch SIF, where that's
+	// the only descriptor there is.
+	descr, archErr := image.SelectArchPartition(fimg, nil)
+	if archErr != nil {
+		var err error
+		descr, _, err = fimg.GetPartPrimSys()
 		if err != nil {
-			return fmt.Errorf("unable to encrypt filesystem at %s: %+v", fsPath, err)
+			return fmt.Errorf("while looking up primary system partition: %s", archErr)
 		}
-		defer os.Remove(loopPath)
+	}
+
+	if descr.Fstype != sif.FsSquash {
+		return fmt.Errorf("primary system partition of %s is not a squashfs filesystem", path)
+	}
+
+	tmp, err := ioutil.TempFile("", "sif-partition-")
+	if err != nil {
+		return fmt.Errorf("while creating temporary file: %s", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
 
-		fsPath = loopPath
+	data, err := ioutil.ReadAll(descr.GetReader(fimg))
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("while reading partition data: %s", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("while writing partition data: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("while closing temporary file: %s", err)
+	}
+
+	extractor := unpacker.New(unpacker.Options{AllowDevices: allowDevices})
+	if err := extractor.ExtractAll(tmpPath, dest); err != nil {
+		return fmt.Errorf("while extracting partition: %s", err)
+	}
+
+	return nil
+}
+
+// zeroDescriptorPadding overwrites the alignment padding sif.CreateContainer
+// leaves between each descriptor's data and the next one with zeroes. That
+// padding is left uninitialized by the underlying file allocation, so
+// without this, two otherwise-identical reproducible builds can still differ
+// byte-for-byte depending on what the filesystem happened to hand back.
+func zeroDescriptorPadding(path string) error {
+	fimg, err := sif.LoadContainer(path, false)
+	if err != nil {
+		return fmt.Errorf("while loading SIF: %w", err)
+	}
+	defer fimg.UnloadContainer()
 
-		encOpts = &encryptionOptions{
-			keyInfo:   *b.Opts.EncryptionKeyInfo,
-			plaintext: plaintext,
+	var used []*sif.Descriptor
+	for i := range fimg.DescrArr {
+		if fimg.DescrArr[i].Used {
+			used = append(used, &fimg.DescrArr[i])
 		}
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].Fileoff < used[j].Fileoff })
 
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("while opening SIF: %w", err)
 	}
+	defer f.Close()
 
-	err = createSIF(path, b, fsPath, encOpts, arch)
+	fi, err := f.Stat()
 	if err != nil {
-		return fmt.Errorf("while creating SIF: %v", err)
+		return fmt.Errorf("while calling stat on SIF: %w", err)
+	}
+
+	for i, d := range used {
+		padStart := d.Fileoff + d.Filelen
+		padEnd := fi.Size()
+		if i+1 < len(used) {
+			padEnd = used[i+1].Fileoff
+		}
+		if padEnd <= padStart {
+			continue
+		}
+		if _, err := f.WriteAt(make([]byte, padEnd-padStart), padStart); err != nil {
+			return fmt.Errorf("while zeroing padding after descriptor %d: %w", i, err)
+		}
 	}
 
 	return nil
@@ -293,3 +383,43 @@ func changeOwner() (int, int, bool) {
 
 	return uid, gid, true
 }
+
+// sifID returns the UUID to use as a SIF's ID. When reproducible is false it
+// is randomly generated, as before. When reproducible is true it is instead
+// derived by hashing the definition, the JSON descriptors in sorted order,
+// and the squashfs digest, so that an identical bundle always yields an
+// identical ID.
+func sifID(definition []byte, jsonObjects map[string][]byte, squashfile string, reproducible bool) (uuid.UUID, error) {
+	if !reproducible {
+		return uuid.NewV4()
+	}
+
+	h := sha256.New()
+	h.Write(definition)
+
+	sorted := make([]string, 0, len(jsonObjects))
+	for name := range jsonObjects {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		io.WriteString(h, name)
+		h.Write(jsonObjects[name])
+	}
+
+	fp, err := os.Open(squashfile)
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("while opening partition file: %s", err)
+	}
+	defer fp.Close()
+
+	if _, err := io.Copy(h, fp); err != nil {
+		return uuid.UUID{}, fmt.Errorf("while hashing partition file: %s", err)
+	}
+
+	var id uuid.UUID
+	copy(id[:], h.Sum(nil))
+
+	return id, nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package assemblers
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hpcng/singularity/pkg/build/types"
+)
+
+// TestReproducibleAssemble builds the same bundle twice with Reproducible set
+// and asserts the two resulting SIFs are byte-for-byte identical.
+func TestReproducibleAssemble(t *testing.T) {
+	if _, err := exec.LookPath("mksquashfs"); err != nil {
+		t.Skip("mksquashfs not available")
+	}
+
+	tmpDir := t.TempDir()
+
+	rootfs := filepath.Join(tmpDir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "bin"), 0o755); err != nil {
+		t.Fatalf("while creating rootfs: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "bin", "sh"), []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatalf("while populating rootfs: %v", err)
+	}
+
+	build := func(dest string) string {
+		b := &types.Bundle{
+			RootfsPath: rootfs,
+			TmpDir:     tmpDir,
+			JSONObjects: map[string][]byte{
+				"labels.json": []byte(`{"a":"b"}`),
+			},
+		}
+		b.Recipe.Raw = []byte("Bootstrap: docker\nFrom: alpine\n")
+
+		a := &SIFAssembler{
+			Reproducible:    true,
+			SourceDateEpoch: time.Unix(0, 0),
+		}
+		if err := a.Assemble(b, dest); err != nil {
+			t.Fatalf("Assemble failed: %v", err)
+		}
+
+		data, err := ioutil.ReadFile(dest)
+		if err != nil {
+			t.Fatalf("while reading %s: %v", dest, err)
+		}
+		return fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+
+	sum1 := build(filepath.Join(tmpDir, "one.sif"))
+	sum2 := build(filepath.Join(tmpDir, "two.sif"))
+
+	if sum1 != sum2 {
+		t.Fatalf("reproducible build produced different SIFs: %s != %s", sum1, sum2)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package crypt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/hpcng/sif/pkg/sif"
+	"github.com/hpcng/singularity/pkg/util/cryptkey"
+)
+
+// SIFEncryptor encrypts, or rotates the key of, the primary system partition
+// of an already assembled SIF image. It holds no state of its own, and can be
+// reused across calls.
+type SIFEncryptor struct{}
+
+// EncryptSIF encrypts the primary system partition of the SIF at path,
+// wrapping the generated filesystem key with keyInfo. The partition must
+// currently be a plaintext squashfs filesystem. This is the out-of-band
+// counterpart to the encryption SIFAssembler.Assemble previously performed
+// inline while the SIF was still being built.
+func (e *SIFEncryptor) EncryptSIF(path string, keyInfo cryptkey.KeyInfo) error {
+	fimg, err := sif.LoadContainer(path, false)
+	if err != nil {
+		return fmt.Errorf("while loading SIF %s: %s", path, err)
+	}
+	defer fimg.UnloadContainer()
+
+	descr, _, err := fimg.GetPartPrimSys()
+	if err != nil {
+		return fmt.Errorf("while looking up primary system partition: %s", err)
+	}
+
+	if descr.Fstype != sif.FsSquash {
+		return fmt.Errorf("primary system partition of %s is not a plaintext squashfs filesystem", path)
+	}
+
+	fsPath, err := extractPartition(fimg, descr)
+	if err != nil {
+		return fmt.Errorf("while extracting partition: %s", err)
+	}
+	defer os.Remove(fsPath)
+
+	plaintext, err := cryptkey.NewPlaintextKey(keyInfo)
+	if err != nil {
+		return fmt.Errorf("unable to obtain encryption key: %s", err)
+	}
+
+	dev := &Device{}
+	loopPath, err := dev.EncryptFilesystem(fsPath, plaintext)
+	if err != nil {
+		return fmt.Errorf("unable to encrypt filesystem at %s: %s", fsPath, err)
+	}
+	defer os.Remove(loopPath)
+
+	encData, err := ioutil.ReadFile(loopPath)
+	if err != nil {
+		return fmt.Errorf("while reading encrypted filesystem: %s", err)
+	}
+
+	wrapped, err := cryptkey.EncryptKey(keyInfo, plaintext)
+	if err != nil {
+		return fmt.Errorf("while encrypting filesystem key: %s", err)
+	}
+
+	partID, err := rewritePartition(fimg, descr, sif.FsEncryptedSquashfs, encData)
+	if err != nil {
+		return fmt.Errorf("while rewriting partition: %s", err)
+	}
+
+	if err := addCryptoMessage(fimg, partID, wrapped); err != nil {
+		return fmt.Errorf("while adding crypto message: %s", err)
+	}
+
+	return nil
+}
+
+// RotateKey re-wraps the filesystem key of the already-encrypted primary
+// system partition of the SIF at path, replacing oldKI with newKI. The
+// filesystem data itself is untouched; only the DataCryptoMessage descriptor
+// holding the wrapped key is rewritten.
+func (e *SIFEncryptor) RotateKey(path string, oldKI, newKI cryptkey.KeyInfo) error {
+	fimg, err := sif.LoadContainer(path, false)
+	if err != nil {
+		return fmt.Errorf("while loading SIF %s: %s", path, err)
+	}
+	defer fimg.UnloadContainer()
+
+	sysDescr, _, err := fimg.GetPartPrimSys()
+	if err != nil {
+		return fmt.Errorf("while looking up primary system partition: %s", err)
+	}
+
+	if sysDescr.Fstype != sif.FsEncryptedSquashfs {
+		return fmt.Errorf("primary system partition of %s is not encrypted", path)
+	}
+
+	cryptDescr, err := findCryptoMessage(fimg, sysDescr.ID)
+	if err != nil {
+		return fmt.Errorf("while looking up crypto message: %s", err)
+	}
+
+	wrapped, err := ioutil.ReadAll(cryptDescr.GetReader(fimg))
+	if err != nil {
+		return fmt.Errorf("while reading wrapped key: %s", err)
+	}
+
+	plaintext, err := cryptkey.DecryptKey(oldKI, wrapped)
+	if err != nil {
+		return fmt.Errorf("unable to unwrap filesystem key: %s", err)
+	}
+
+	rewrapped, err := cryptkey.EncryptKey(newKI, plaintext)
+	if err != nil {
+		return fmt.Errorf("unable to re-wrap filesystem key: %s", err)
+	}
+
+	if err := fimg.DeleteObject(cryptDescr.ID, sif.DelZero); err != nil {
+		return fmt.Errorf("while removing previous crypto message: %s", err)
+	}
+
+	if err := addCryptoMessage(fimg, sysDescr.ID, rewrapped); err != nil {
+		return fmt.Errorf("while adding crypto message: %s", err)
+	}
+
+	return nil
+}
+
+// extractPartition copies the data object backing descr out to a newly
+// created temporary file, returning its path.
+func extractPartition(fimg *sif.FileImage, descr *sif.Descriptor) (string, error) {
+	tmp, err := ioutil.TempFile("", "sif-partition-")
+	if err != nil {
+		return "", fmt.Errorf("while creating temporary file: %s", err)
+	}
+	defer tmp.Close()
+
+	data, err := ioutil.ReadAll(descr.GetReader(fimg))
+	if err != nil {
+		return "", fmt.Errorf("while reading partition data: %s", err)
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		return "", fmt.Errorf("while writing partition data: %s", err)
+	}
+
+	return tmp.Name(), nil
+}
+
+// rewritePartition replaces the data object backing descr with data, and
+// updates its filesystem type to fsType. It returns the ID of the new
+// descriptor, which callers should use as the Link for any dependent
+// descriptor (e.g. a DataCryptoMessage).
+func rewritePartition(fimg *sif.FileImage, descr *sif.Descriptor, fsType sif.Fstype, data []byte) (uint32, error) {
+	partType, arch := descr.Parttype, descr.GetArch()
+
+	if err := fimg.DeleteObject(descr.ID, sif.DelZero); err != nil {
+		return 0, fmt.Errorf("while removing previous partition: %s", err)
+	}
+
+	in := sif.DescriptorInput{
+		Datatype: sif.DataPartition,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Data:     data,
+		Size:     int64(len(data)),
+	}
+	if err := in.SetPartExtra(fsType, partType, arch); err != nil {
+		return 0, err
+	}
+
+	if err := fimg.AddObject(in); err != nil {
+		return 0, fmt.Errorf("while adding rewritten partition: %s", err)
+	}
+
+	newDescr, _, err := fimg.GetPartPrimSys()
+	if err != nil {
+		return 0, fmt.Errorf("while looking up rewritten partition: %s", err)
+	}
+
+	return newDescr.ID, nil
+}
+
+// addCryptoMessage appends a DataCryptoMessage descriptor linked to partID,
+// holding the RSA-OAEP wrapped filesystem key.
+func addCryptoMessage(fimg *sif.FileImage, partID uint32, wrapped []byte) error {
+	in := sif.DescriptorInput{
+		Datatype: sif.DataCryptoMessage,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     partID,
+		Data:     wrapped,
+		Size:     int64(len(wrapped)),
+	}
+	if err := in.SetCryptoMsgExtra(sif.FormatPEM, sif.MessageRSAOAEP); err != nil {
+		return err
+	}
+
+	return fimg.AddObject(in)
+}
+
+// findCryptoMessage returns the DataCryptoMessage descriptor linked to
+// partID.
+func findCryptoMessage(fimg *sif.FileImage, partID uint32) (*sif.Descriptor, error) {
+	for _, descr := range fimg.DescrArr {
+		if !descr.Used || descr.Datatype != sif.DataCryptoMessage {
+			continue
+		}
+		if descr.Link == partID {
+			return &descr, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no crypto message linked to partition %d", partID)
+}
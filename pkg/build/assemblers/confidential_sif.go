@@ -0,0 +1,312 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package assemblers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/hpcng/sif/pkg/sif"
+	"github.com/hpcng/singularity/pkg/sylog"
+	"github.com/hpcng/singularity/pkg/util/cryptkey"
+	uuid "github.com/satori/go.uuid"
+)
+
+// confidentialSlack is extra headroom added on top of the 1.25x bundle size
+// estimate, to leave room for the ext4 filesystem's own metadata.
+const confidentialSlack = 64 * 1024 * 1024 // 64 MiB
+
+// AttestationTarget describes one confidential-computing environment that
+// should be able to unwrap the disk encryption passphrase of a
+// ConfidentialSIFAssembler image and attest itself before doing so.
+type AttestationTarget struct {
+	WorkloadID        string
+	AttestationURL    string
+	TeeType           string
+	MeasurementPolicy string
+	KeyInfo           cryptkey.KeyInfo
+}
+
+// workloadConfig is the JSON document stored as the krun-sev-<id>.json
+// descriptor for each AttestationTarget, consumed by the guest's attestation
+// agent.
+type workloadConfig struct {
+	WorkloadID     string `json:"workload_id"`
+	TeeData        string `json:"teeData"`
+	AttestationURL string `json:"attestation_url"`
+}
+
+// ConfidentialSIFAssembler builds a SIF whose primary partition is a
+// LUKS2-encrypted ext4 disk image, suitable for running under a
+// confidential-computing guest such as AMD SEV-SNP or Intel TDX, instead of
+// the usual plaintext or dm-crypt-over-squashfs partition.
+type ConfidentialSIFAssembler struct {
+	CryptsetupPath string
+	MkfsExt4Path   string
+}
+
+func (a *ConfidentialSIFAssembler) cryptsetupPath() string {
+	if a.CryptsetupPath != "" {
+		return a.CryptsetupPath
+	}
+	return "cryptsetup"
+}
+
+func (a *ConfidentialSIFAssembler) mkfsExt4Path() string {
+	if a.MkfsExt4Path != "" {
+		return a.MkfsExt4Path
+	}
+	return "mkfs.ext4"
+}
+
+// Assemble creates a confidential-workload SIF at path from the rootfs at
+// rootfsPath, encrypting it with LUKS2 and wrapping the resulting
+// passphrase for each of targets.
+func (a *ConfidentialSIFAssembler) Assemble(rootfsPath, path string, bundleSize int64, targets []AttestationTarget) error {
+	sylog.Infof("Creating confidential-workload SIF file...")
+
+	imgPath, passphrase, err := a.buildEncryptedImage(rootfsPath, bundleSize)
+	if err != nil {
+		return fmt.Errorf("while building encrypted disk image: %v", err)
+	}
+	defer os.Remove(imgPath)
+
+	if err := a.createSIF(path, imgPath, passphrase, targets); err != nil {
+		return fmt.Errorf("while creating confidential SIF: %v", err)
+	}
+
+	return nil
+}
+
+// buildEncryptedImage creates an ext4 image sized off bundleSize, formats it
+// with LUKS2 under a randomly generated passphrase, and copies rootfsPath
+// into it. It returns the path to the resulting disk image and the
+// passphrase used to unlock it.
+func (a *ConfidentialSIFAssembler) buildEncryptedImage(rootfsPath string, bundleSize int64) (string, []byte, error) {
+	size := int64(float64(bundleSize)*1.25) + confidentialSlack
+
+	f, err := ioutil.TempFile("", "cw-image-")
+	if err != nil {
+		return "", nil, fmt.Errorf("while creating temporary disk image: %v", err)
+	}
+	imgPath := f.Name()
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(imgPath)
+		return "", nil, fmt.Errorf("while sizing disk image: %v", err)
+	}
+	f.Close()
+
+	passphrase := make([]byte, 32)
+	if _, err := rand.Read(passphrase); err != nil {
+		os.Remove(imgPath)
+		return "", nil, fmt.Errorf("while generating passphrase: %v", err)
+	}
+	hexPassphrase := []byte(hex.EncodeToString(passphrase))
+
+	if err := a.luksFormat(imgPath, hexPassphrase); err != nil {
+		os.Remove(imgPath)
+		return "", nil, err
+	}
+
+	mapperName, err := randomMapperName()
+	if err != nil {
+		os.Remove(imgPath)
+		return "", nil, fmt.Errorf("while naming mapper device: %v", err)
+	}
+
+	if err := a.luksOpen(imgPath, mapperName, hexPassphrase); err != nil {
+		os.Remove(imgPath)
+		return "", nil, err
+	}
+	defer a.luksClose(mapperName)
+
+	mapperPath := "/dev/mapper/" + mapperName
+
+	if err := runCommand(a.mkfsExt4Path(), "-F", mapperPath); err != nil {
+		os.Remove(imgPath)
+		return "", nil, fmt.Errorf("while formatting ext4 filesystem: %v", err)
+	}
+
+	if err := copyRootfs(rootfsPath, mapperPath); err != nil {
+		os.Remove(imgPath)
+		return "", nil, fmt.Errorf("while copying rootfs into disk image: %v", err)
+	}
+
+	return imgPath, hexPassphrase, nil
+}
+
+// randomMapperName returns a dm-crypt mapper device name built from a fresh
+// random nonce, not from the disk encryption passphrase: the mapper name is
+// visible locally (/dev/mapper/, dmsetup ls, process args/logs), so it must
+// never be derived from key material.
+func randomMapperName() (string, error) {
+	nonce := make([]byte, 4)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return "cw-" + hex.EncodeToString(nonce), nil
+}
+
+func (a *ConfidentialSIFAssembler) luksFormat(imgPath string, passphrase []byte) error {
+	cmd := exec.Command(a.cryptsetupPath(), "luksFormat", "--type", "luks2", "--batch-mode", imgPath, "-")
+	cmd.Stdin = bytes.NewReader(passphrase)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("while formatting LUKS2 volume: %v: %s", err, out)
+	}
+	return nil
+}
+
+func (a *ConfidentialSIFAssembler) luksOpen(imgPath, mapperName string, passphrase []byte) error {
+	cmd := exec.Command(a.cryptsetupPath(), "luksOpen", imgPath, mapperName, "-")
+	cmd.Stdin = bytes.NewReader(passphrase)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("while opening LUKS2 volume: %v: %s", err, out)
+	}
+	return nil
+}
+
+func (a *ConfidentialSIFAssembler) luksClose(mapperName string) {
+	if out, err := exec.Command(a.cryptsetupPath(), "luksClose", mapperName).CombinedOutput(); err != nil {
+		sylog.Warningf("while closing LUKS2 volume %s: %v: %s", mapperName, err, out)
+	}
+}
+
+func copyRootfs(rootfsPath, mapperPath string) error {
+	mountDir, err := ioutil.TempDir("", "cw-mount-")
+	if err != nil {
+		return fmt.Errorf("while creating mount point: %v", err)
+	}
+	defer os.Remove(mountDir)
+
+	if err := runCommand("mount", mapperPath, mountDir); err != nil {
+		return err
+	}
+	defer runCommand("umount", mountDir)
+
+	return runCommand("cp", "-a", rootfsPath+"/.", mountDir+"/")
+}
+
+func runCommand(name string, args ...string) error {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("while running %s: %v: %s", name, err, out)
+	}
+	return nil
+}
+
+// createSIF assembles the confidential SIF at path: one DataPartition
+// descriptor of type sif.FsLUKS2 wrapping imgPath, and for each target a
+// DataGenericJSON workload config descriptor plus a DataCryptoMessage
+// descriptor wrapping passphrase for that target.
+func (a *ConfidentialSIFAssembler) createSIF(path, imgPath string, passphrase []byte, targets []AttestationTarget) error {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return fmt.Errorf("sif id generation failed: %v", err)
+	}
+
+	cinfo := sif.CreateInfo{
+		Pathname:   path,
+		Launchstr:  sif.HdrLaunch,
+		Sifversion: sif.HdrVersion,
+		ID:         id,
+	}
+
+	fp, err := os.Open(imgPath)
+	if err != nil {
+		return fmt.Errorf("while opening disk image: %v", err)
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return fmt.Errorf("while calling stat on disk image: %v", err)
+	}
+
+	parinput := sif.DescriptorInput{
+		Datatype: sif.DataPartition,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Fname:    imgPath,
+		Fp:       fp,
+		Size:     fi.Size(),
+	}
+	if err := parinput.SetPartExtra(sif.FsLUKS2, sif.PartPrimSys, sif.GetSIFArch(runtime.GOARCH)); err != nil {
+		return err
+	}
+	cinfo.InputDescr = append(cinfo.InputDescr, parinput)
+
+	for _, target := range targets {
+		cfg := workloadConfig{
+			WorkloadID:     target.WorkloadID,
+			TeeData:        target.TeeType + ":" + target.MeasurementPolicy,
+			AttestationURL: target.AttestationURL,
+		}
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			return fmt.Errorf("while marshaling workload config for %s: %v", target.WorkloadID, err)
+		}
+
+		// Fname is unique per target so a guest agent with several
+		// workload configs to choose from can tell them apart; the
+		// paired DataCryptoMessage below links to this descriptor's ID
+		// rather than the shared partition, so the wrapped passphrase
+		// can be matched back to its config.
+		jsonInput := sif.DescriptorInput{
+			Datatype: sif.DataGenericJSON,
+			Groupid:  sif.DescrDefaultGroup,
+			Link:     sif.DescrUnusedLink,
+			Data:     data,
+			Fname:    fmt.Sprintf("krun-sev-%s.json", target.WorkloadID),
+		}
+		jsonInput.Size = int64(len(data))
+		cinfo.InputDescr = append(cinfo.InputDescr, jsonInput)
+		jsonID := uint32(len(cinfo.InputDescr))
+
+		wrapped, err := cryptkey.EncryptKey(target.KeyInfo, passphrase)
+		if err != nil {
+			return fmt.Errorf("while wrapping passphrase for %s: %v", target.WorkloadID, err)
+		}
+
+		cryptInput := sif.DescriptorInput{
+			Datatype: sif.DataCryptoMessage,
+			Groupid:  sif.DescrDefaultGroup,
+			Link:     jsonID,
+			Data:     wrapped,
+			Size:     int64(len(wrapped)),
+		}
+		if err := cryptInput.SetCryptoMsgExtra(sif.FormatPEM, sif.MessageRSAOAEP); err != nil {
+			return err
+		}
+		cinfo.InputDescr = append(cinfo.InputDescr, cryptInput)
+	}
+
+	os.RemoveAll(path)
+
+	f, err := sif.CreateContainer(cinfo)
+	if err != nil {
+		return fmt.Errorf("while creating container: %v", err)
+	}
+
+	if err := f.UnloadContainer(); err != nil {
+		return fmt.Errorf("while unloading container: %v", err)
+	}
+
+	if len(targets) > 0 {
+		if err := verifyLinkedPairs(path, sif.DataGenericJSON, sif.DataCryptoMessage); err != nil {
+			return fmt.Errorf("workload configs did not link to their wrapped keys correctly: %w", err)
+		}
+	}
+
+	return nil
+}
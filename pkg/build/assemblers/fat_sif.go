@@ -0,0 +1,328 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package assemblers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/hpcng/sif/pkg/sif"
+	"github.com/hpcng/singularity/internal/pkg/util/crypt"
+	"github.com/hpcng/singularity/pkg/build/types"
+	"github.com/hpcng/singularity/pkg/image/packer"
+	"github.com/hpcng/singularity/pkg/sylog"
+	"github.com/hpcng/singularity/pkg/util/cryptkey"
+	uuid "github.com/satori/go.uuid"
+)
+
+// ArchRootfs pairs a target architecture with the path to an already
+// populated rootfs for that architecture.
+type ArchRootfs struct {
+	Arch       string
+	RootfsPath string
+}
+
+// FatSIFAssembler builds a single SIF containing one primary system
+// partition per architecture passed to Assemble, so that the resulting image can run
+// unmodified on any of them.
+type FatSIFAssembler struct {
+	// MksquashfsProcs is passed as mksquashfs's own -processors flag for
+	// each per-architecture squashfs build, same as SIFAssembler's field of
+	// the same name in sif.go.
+	MksquashfsProcs uint
+	// Concurrency bounds how many per-architecture mksquashfs builds packAll
+	// runs at once; zero means fully parallel (one goroutine per input).
+	// This is distinct from MksquashfsProcs: that controls threads *within*
+	// a single mksquashfs invocation, this controls how many invocations
+	// run at the same time.
+	Concurrency          uint
+	MksquashfsMem        string
+	MksquashfsPath       string
+	Compression          packer.Compression
+	CompressionLevel     int
+	CompressionBlockSize uint
+	EncryptionKeyInfo    *cryptkey.KeyInfo
+}
+
+type archPartition struct {
+	arch       string
+	squashfile string
+}
+
+// Assemble creates a fat SIF image at path from the given per-architecture
+// rootfs inputs, sharing the bundle's definition and JSON descriptors across
+// every architecture.
+func (a *FatSIFAssembler) Assemble(inputs []ArchRootfs, b *types.Bundle, path string) error {
+	if len(inputs) == 0 {
+		return fmt.Errorf("no architecture inputs provided")
+	}
+
+	parts, err := a.packAll(inputs, b.TmpDir)
+	if err != nil {
+		return fmt.Errorf("while packing squashfs images: %v", err)
+	}
+	defer func() {
+		for _, p := range parts {
+			os.Remove(p.squashfile)
+		}
+	}()
+
+	if err := a.createFatSIF(path, b, parts); err != nil {
+		return fmt.Errorf("while creating fat SIF: %v", err)
+	}
+
+	return nil
+}
+
+// packAll runs mksquashfs for every input concurrently, bounded by
+// Concurrency, and returns the resulting squashfs files in the same order as
+// inputs.
+func (a *FatSIFAssembler) packAll(inputs []ArchRootfs, tmpDir string) ([]archPartition, error) {
+	procs := a.Concurrency
+	if procs == 0 || int(procs) > len(inputs) {
+		procs = uint(len(inputs))
+	}
+
+	sem := make(chan struct{}, procs)
+	parts := make([]archPartition, len(inputs))
+	errs := make([]error, len(inputs))
+
+	var wg sync.WaitGroup
+	for i, in := range inputs {
+		wg.Add(1)
+		go func(i int, in ArchRootfs) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			squashfile, err := a.pack(in, tmpDir)
+			if err != nil {
+				errs[i] = fmt.Errorf("while packing %s: %v", in.Arch, err)
+				return
+			}
+			parts[i] = archPartition{arch: in.Arch, squashfile: squashfile}
+		}(i, in)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			for _, p := range parts {
+				if p.squashfile != "" {
+					os.Remove(p.squashfile)
+				}
+			}
+			return nil, err
+		}
+	}
+
+	return parts, nil
+}
+
+func (a *FatSIFAssembler) pack(in ArchRootfs, tmpDir string) (string, error) {
+	sylog.Infof("Creating squashfs for %s...", in.Arch)
+
+	s := packer.NewSquashfs()
+	s.MksquashfsPath = a.MksquashfsPath
+
+	f, err := ioutil.TempFile(tmpDir, "squashfs-"+in.Arch+"-")
+	if err != nil {
+		return "", fmt.Errorf("while creating temporary file for squashfs: %v", err)
+	}
+	fsPath := f.Name()
+	f.Close()
+
+	if err := s.ProbeCompression(a.Compression); err != nil {
+		os.Remove(fsPath)
+		return "", err
+	}
+	compFlags, err := s.CompressionArgs(a.Compression, a.CompressionLevel, a.CompressionBlockSize)
+	if err != nil {
+		os.Remove(fsPath)
+		return "", err
+	}
+
+	flags := append([]string{"-noappend"}, compFlags...)
+	if a.MksquashfsMem != "" {
+		flags = append(flags, "-mem", a.MksquashfsMem)
+	}
+	if a.MksquashfsProcs != 0 {
+		flags = append(flags, "-processors", fmt.Sprint(a.MksquashfsProcs))
+	}
+
+	if err := s.Create([]string{in.RootfsPath}, fsPath, flags); err != nil {
+		os.Remove(fsPath)
+		return "", fmt.Errorf("while creating squashfs: %v", err)
+	}
+
+	return fsPath, nil
+}
+
+// createFatSIF assembles the final SIF from the already packed per-arch
+// squashfs images, with one DataPartition descriptor (and, if
+// a.EncryptionKeyInfo is set, one linked DataCryptoMessage descriptor) per
+// architecture.
+func (a *FatSIFAssembler) createFatSIF(path string, b *types.Bundle, parts []archPartition) error {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return fmt.Errorf("sif id generation failed: %v", err)
+	}
+
+	cinfo := sif.CreateInfo{
+		Pathname:   path,
+		Launchstr:  sif.HdrLaunch,
+		Sifversion: sif.HdrVersion,
+		ID:         id,
+	}
+
+	definput := sif.DescriptorInput{
+		Datatype: sif.DataDeffile,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Data:     b.Recipe.Raw,
+	}
+	definput.Size = int64(binary.Size(definput.Data))
+	cinfo.InputDescr = append(cinfo.InputDescr, definput)
+
+	sorted := make([]string, 0, len(b.JSONObjects))
+	for name := range b.JSONObjects {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		if len(b.JSONObjects[name]) == 0 {
+			continue
+		}
+		in := sif.DescriptorInput{
+			Datatype: sif.DataGenericJSON,
+			Groupid:  sif.DescrDefaultGroup,
+			Link:     sif.DescrUnusedLink,
+			Data:     b.JSONObjects[name],
+			Fname:    name,
+		}
+		in.Size = int64(binary.Size(in.Data))
+		cinfo.InputDescr = append(cinfo.InputDescr, in)
+	}
+
+	// Partition file handles must stay open until after CreateContainer
+	// reads through them, so they're collected here rather than closed
+	// inside addPartition.
+	var fps []*os.File
+	defer func() {
+		for _, fp := range fps {
+			fp.Close()
+		}
+	}()
+
+	for _, part := range parts {
+		fp, err := a.addPartition(&cinfo, part)
+		if err != nil {
+			return err
+		}
+		fps = append(fps, fp)
+	}
+
+	os.RemoveAll(path)
+
+	f, err := sif.CreateContainer(cinfo)
+	if err != nil {
+		return fmt.Errorf("while creating container: %s", err)
+	}
+
+	if err := f.UnloadContainer(); err != nil {
+		return fmt.Errorf("while unloading container: %s", err)
+	}
+
+	if a.EncryptionKeyInfo != nil {
+		if err := verifyLinkedPairs(path, sif.DataPartition, sif.DataCryptoMessage); err != nil {
+			return fmt.Errorf("partition encryption keys did not link correctly: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// addPartition appends the DataPartition descriptor for part to cinfo,
+// encrypting it first and appending a linked DataCryptoMessage descriptor if
+// a.EncryptionKeyInfo is set. It returns the opened partition file handle,
+// which the caller must keep open until after sif.CreateContainer runs and
+// close itself.
+func (a *FatSIFAssembler) addPartition(cinfo *sif.CreateInfo, part archPartition) (*os.File, error) {
+	fsPath := part.squashfile
+	fsType := sif.FsSquash
+
+	var wrappedKey []byte
+
+	if a.EncryptionKeyInfo != nil {
+		plaintext, err := cryptkey.NewPlaintextKey(*a.EncryptionKeyInfo)
+		if err != nil {
+			return nil, fmt.Errorf("unable to obtain encryption key for %s: %v", part.arch, err)
+		}
+
+		cryptDev := &crypt.Device{}
+		loopPath, err := cryptDev.EncryptFilesystem(fsPath, plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encrypt filesystem for %s: %v", part.arch, err)
+		}
+		defer os.Remove(loopPath)
+
+		fsPath = loopPath
+		fsType = sif.FsEncryptedSquashfs
+
+		wrappedKey, err = cryptkey.EncryptKey(*a.EncryptionKeyInfo, plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("while encrypting filesystem key for %s: %v", part.arch, err)
+		}
+	}
+
+	fp, err := os.Open(fsPath)
+	if err != nil {
+		return nil, fmt.Errorf("while opening partition file for %s: %s", part.arch, err)
+	}
+
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("while calling stat on partition file for %s: %s", part.arch, err)
+	}
+
+	parinput := sif.DescriptorInput{
+		Datatype: sif.DataPartition,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Fname:    fsPath,
+		Fp:       fp,
+		Size:     fi.Size(),
+	}
+	if err := parinput.SetPartExtra(fsType, sif.PartPrimSys, sif.GetSIFArch(part.arch)); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	cinfo.InputDescr = append(cinfo.InputDescr, parinput)
+
+	if wrappedKey != nil {
+		partID := uint32(len(cinfo.InputDescr))
+		cryptInput := sif.DescriptorInput{
+			Datatype: sif.DataCryptoMessage,
+			Groupid:  sif.DescrDefaultGroup,
+			Link:     partID,
+			Data:     wrappedKey,
+			Size:     int64(len(wrappedKey)),
+		}
+		if err := cryptInput.SetCryptoMsgExtra(sif.FormatPEM, sif.MessageRSAOAEP); err != nil {
+			fp.Close()
+			return nil, err
+		}
+		cinfo.InputDescr = append(cinfo.InputDescr, cryptInput)
+	}
+
+	return fp, nil
+}
@@ -0,0 +1,681 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package assemblers
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	containersImage "github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/transports/alltransports"
+	containersTypes "github.com/containers/image/v5/types"
+	"github.com/hpcng/sif/pkg/sif"
+	"github.com/hpcng/singularity/pkg/image/packer"
+	"github.com/hpcng/singularity/pkg/image/unpacker"
+	"github.com/hpcng/singularity/pkg/sylog"
+	digest "github.com/opencontainers/go-digest"
+	uuid "github.com/satori/go.uuid"
+)
+
+// OCISIFAssembler builds a SIF directly from an OCI image reference,
+// streaming each layer through sqfstar instead of unpacking a full rootfs to
+// disk first. The original OCI config and manifest are preserved as
+// DataGenericJSON descriptors so the image can round-trip back out via
+// ToOCI.
+type OCISIFAssembler struct {
+	SqfstarPath          string
+	Compression          packer.Compression
+	CompressionLevel     int
+	CompressionBlockSize uint
+}
+
+func (a *OCISIFAssembler) sqfstarPath() string {
+	if a.SqfstarPath != "" {
+		return a.SqfstarPath
+	}
+	return "sqfstar"
+}
+
+// Assemble resolves ref (docker://, oci://, containers-storage:, ...) and
+// writes a SIF to path whose primary system partition is a squashfs built
+// directly from ref's layers.
+func (a *OCISIFAssembler) Assemble(ctx context.Context, ref, path string, sysCtx *containersTypes.SystemContext) error {
+	sylog.Infof("Creating SIF from OCI image %s...", ref)
+
+	imgRef, err := alltransports.ParseImageName(ref)
+	if err != nil {
+		return fmt.Errorf("while parsing image reference %s: %v", ref, err)
+	}
+
+	src, err := imgRef.NewImageSource(ctx, sysCtx)
+	if err != nil {
+		return fmt.Errorf("while opening image source: %v", err)
+	}
+	defer src.Close()
+
+	img, err := containersImage.FromSource(ctx, sysCtx, src)
+	if err != nil {
+		return fmt.Errorf("while reading image: %v", err)
+	}
+	defer img.Close()
+
+	configBytes, err := img.ConfigBlob(ctx)
+	if err != nil {
+		return fmt.Errorf("while reading image config: %v", err)
+	}
+
+	ociConfig, err := img.OCIConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("while reading image config: %v", err)
+	}
+	arch := ociConfig.Architecture
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+
+	manifestBytes, _, err := img.Manifest(ctx)
+	if err != nil {
+		return fmt.Errorf("while reading image manifest: %v", err)
+	}
+
+	fsPath, err := a.buildSquashfs(ctx, src, img.LayerInfos())
+	if err != nil {
+		return fmt.Errorf("while building squashfs from layers: %v", err)
+	}
+	defer os.Remove(fsPath)
+
+	return createOCISIF(path, fsPath, arch, map[string][]byte{
+		"oci-config.json":   configBytes,
+		"oci-manifest.json": manifestBytes,
+	})
+}
+
+// buildSquashfs resolves the final, whiteout-applied file tree across every
+// layer in layers and streams it through sqfstar, producing a squashfs file
+// without ever unpacking the layers to a rootfs on disk.
+func (a *OCISIFAssembler) buildSquashfs(ctx context.Context, src containersTypes.ImageSource, layers []containersTypes.BlobInfo) (string, error) {
+	layerPaths, err := fetchLayers(ctx, src, layers)
+	if err != nil {
+		return "", fmt.Errorf("while fetching layers: %v", err)
+	}
+	defer func() {
+		for _, p := range layerPaths {
+			os.Remove(p)
+		}
+	}()
+
+	keep, err := resolveWhiteouts(layerPaths)
+	if err != nil {
+		return "", fmt.Errorf("while resolving whiteouts: %v", err)
+	}
+
+	f, err := ioutil.TempFile("", "oci-squashfs-")
+	if err != nil {
+		return "", fmt.Errorf("while creating temporary file: %v", err)
+	}
+	fsPath := f.Name()
+	f.Close()
+
+	s := packer.NewSquashfs()
+	compFlags, err := s.CompressionArgs(a.Compression, a.CompressionLevel, a.CompressionBlockSize)
+	if err != nil {
+		os.Remove(fsPath)
+		return "", err
+	}
+
+	args := append([]string{fsPath}, compFlags...)
+	cmd := exec.Command(a.sqfstarPath(), args...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		os.Remove(fsPath)
+		return "", fmt.Errorf("while opening sqfstar stdin: %v", err)
+	}
+
+	var writeErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer stdin.Close()
+		writeErr = streamLayers(layerPaths, keep, stdin)
+	}()
+
+	out, err := cmd.CombinedOutput()
+	<-done
+	if err != nil {
+		os.Remove(fsPath)
+		return "", fmt.Errorf("while running sqfstar: %v: %s", err, out)
+	}
+	if writeErr != nil {
+		os.Remove(fsPath)
+		return "", fmt.Errorf("while streaming layers: %v", writeErr)
+	}
+
+	return fsPath, nil
+}
+
+// fetchLayers downloads each of layers exactly once, gunzipping it if it's
+// gzip-compressed (as essentially every real OCI/Docker layer is), and
+// returns the path to each layer's decompressed tar, in layer order. Both
+// resolveWhiteouts and streamLayers need to read every layer's content, but
+// neither is allowed to re-fetch it from the registry, so they both read
+// from these local files instead.
+func fetchLayers(ctx context.Context, src containersTypes.ImageSource, layers []containersTypes.BlobInfo) ([]string, error) {
+	paths := make([]string, 0, len(layers))
+	cleanup := func() {
+		for _, p := range paths {
+			os.Remove(p)
+		}
+	}
+
+	for _, layer := range layers {
+		rc, _, err := src.GetBlob(ctx, layer, none.NoCache)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("while fetching layer %s: %v", layer.Digest, err)
+		}
+
+		tr, err := gunzipReader(rc)
+		if err != nil {
+			rc.Close()
+			cleanup()
+			return nil, fmt.Errorf("while reading layer %s: %v", layer.Digest, err)
+		}
+
+		f, err := ioutil.TempFile("", "oci-sif-layer-")
+		if err != nil {
+			rc.Close()
+			cleanup()
+			return nil, err
+		}
+
+		_, copyErr := io.Copy(f, tr)
+		closeErr := f.Close()
+		rc.Close()
+		if copyErr != nil {
+			os.Remove(f.Name())
+			cleanup()
+			return nil, fmt.Errorf("while extracting layer %s: %v", layer.Digest, copyErr)
+		}
+		if closeErr != nil {
+			os.Remove(f.Name())
+			cleanup()
+			return nil, closeErr
+		}
+
+		paths = append(paths, f.Name())
+	}
+
+	return paths, nil
+}
+
+// gunzipReader wraps r in a gzip reader if its content is gzip-compressed,
+// leaving it untouched otherwise, so callers can handle both layer media
+// types (tar and tar+gzip) without caring which one they were given.
+func gunzipReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(2)
+	if err != nil {
+		if err == io.EOF {
+			return br, nil
+		}
+		return nil, err
+	}
+
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+
+	return br, nil
+}
+
+// resolveWhiteouts scans every layer once, without keeping file content, and
+// returns the set of "layerIndex:path" entries that survive to the final
+// image: the last non-whiteout write to a path wins, and a whiteout removes
+// every earlier write as well as itself.
+func resolveWhiteouts(layerPaths []string) (map[string]bool, error) {
+	winner := map[string]int{}
+
+	for i, layerPath := range layerPaths {
+		if err := walkLayerTar(layerPath, func(hdr *tar.Header, _ io.Reader) error {
+			name := path.Clean("/" + hdr.Name)
+			base := path.Base(name)
+
+			if base == ".wh..wh..opq" {
+				// Opaque whiteout: every entry written under this directory
+				// by an earlier layer is now hidden.
+				dir := path.Dir(name)
+				for p, w := range winner {
+					if w < i && strings.HasPrefix(p, dir+"/") {
+						delete(winner, p)
+					}
+				}
+				return nil
+			}
+
+			if strings.HasPrefix(base, ".wh.") {
+				delete(winner, path.Join(path.Dir(name), strings.TrimPrefix(base, ".wh.")))
+				return nil
+			}
+
+			winner[name] = i
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("while reading layer %s: %v", layerPath, err)
+		}
+	}
+
+	keep := make(map[string]bool, len(winner))
+	for p, i := range winner {
+		keep[fmt.Sprintf("%d:%s", i, p)] = true
+	}
+
+	return keep, nil
+}
+
+// streamLayers writes out only the entries that resolveWhiteouts determined
+// survive, as a single merged tar stream, reading each layer from its local
+// decompressed copy rather than fetching it again.
+func streamLayers(layerPaths []string, keep map[string]bool, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	for i, layerPath := range layerPaths {
+		if err := walkLayerTar(layerPath, func(hdr *tar.Header, r io.Reader) error {
+			name := path.Clean("/" + hdr.Name)
+			if !keep[fmt.Sprintf("%d:%s", i, name)] {
+				return nil
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := io.Copy(tw, r); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("while reading layer %s: %v", layerPath, err)
+		}
+	}
+
+	return nil
+}
+
+// walkLayerTar opens the decompressed layer tar at layerPath and calls fn for
+// every entry in it.
+func walkLayerTar(layerPath string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// createOCISIF assembles the final SIF at path from the already built
+// squashfs at fsPath, storing jsonObjects as DataGenericJSON descriptors.
+func createOCISIF(path, fsPath, arch string, jsonObjects map[string][]byte) error {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return fmt.Errorf("sif id generation failed: %v", err)
+	}
+
+	cinfo := sif.CreateInfo{
+		Pathname:   path,
+		Launchstr:  sif.HdrLaunch,
+		Sifversion: sif.HdrVersion,
+		ID:         id,
+	}
+
+	for _, name := range []string{"oci-config.json", "oci-manifest.json"} {
+		data := jsonObjects[name]
+		in := sif.DescriptorInput{
+			Datatype: sif.DataGenericJSON,
+			Groupid:  sif.DescrDefaultGroup,
+			Link:     sif.DescrUnusedLink,
+			Data:     data,
+			Fname:    name,
+		}
+		in.Size = int64(binary.Size(in.Data))
+		cinfo.InputDescr = append(cinfo.InputDescr, in)
+	}
+
+	fp, err := os.Open(fsPath)
+	if err != nil {
+		return fmt.Errorf("while opening partition file: %s", err)
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return fmt.Errorf("while calling stat on partition file: %s", err)
+	}
+
+	parinput := sif.DescriptorInput{
+		Datatype: sif.DataPartition,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Fname:    fsPath,
+		Fp:       fp,
+		Size:     fi.Size(),
+	}
+	if err := parinput.SetPartExtra(sif.FsSquash, sif.PartPrimSys, sif.GetSIFArch(arch)); err != nil {
+		return err
+	}
+	cinfo.InputDescr = append(cinfo.InputDescr, parinput)
+
+	os.RemoveAll(path)
+
+	f, err := sif.CreateContainer(cinfo)
+	if err != nil {
+		return fmt.Errorf("while creating container: %s", err)
+	}
+
+	return f.UnloadContainer()
+}
+
+// ToOCI reassembles a valid OCI image at destRef from the SIF at path: the
+// original oci-config.json is reused with its rootfs and history rewritten
+// to describe a single layer, and the merged squashfs
+// partition is safely extracted and re-packed as a single new layer, since
+// the original per-layer boundaries are not preserved by Assemble.
+func (a *OCISIFAssembler) ToOCI(ctx context.Context, path, destRef string) error {
+	fimg, err := sif.LoadContainer(path, true)
+	if err != nil {
+		return fmt.Errorf("while loading SIF %s: %s", path, err)
+	}
+	defer fimg.UnloadContainer()
+
+	descr, _, err := fimg.GetPartPrimSys()
+	if err != nil {
+		return fmt.Errorf("while looking up primary system partition: %s", err)
+	}
+
+	tmp, err := ioutil.TempFile("", "oci-sif-partition-")
+	if err != nil {
+		return fmt.Errorf("while creating temporary file: %s", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	data, err := ioutil.ReadAll(descr.GetReader(fimg))
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("while reading partition data: %s", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("while writing partition data: %s", err)
+	}
+	tmp.Close()
+
+	rootfsDir, err := ioutil.TempDir("", "oci-sif-rootfs-")
+	if err != nil {
+		return fmt.Errorf("while creating temporary rootfs: %s", err)
+	}
+	defer os.RemoveAll(rootfsDir)
+
+	extractor := unpacker.New(unpacker.Options{})
+	if err := extractor.ExtractAll(tmpPath, rootfsDir); err != nil {
+		return fmt.Errorf("while extracting partition: %s", err)
+	}
+
+	imgRef, err := alltransports.ParseImageName(destRef)
+	if err != nil {
+		return fmt.Errorf("while parsing destination reference %s: %v", destRef, err)
+	}
+
+	return writeOCILayout(ctx, imgRef, rootfsDir, findJSONDescriptor(fimg, "oci-config.json"))
+}
+
+// ociDescriptor and ociManifest are minimal mirrors of the OCI image-spec
+// manifest shape, just enough to assemble the single-layer manifest ToOCI
+// produces.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// writeOCILayout packs rootfsDir as a single gzip-compressed layer, rewrites
+// configBytes (the original image's config) so its rootfs.diff_ids and
+// history describe exactly that one merged layer instead of the source
+// image's original layer set, uploads both to imgRef, and commits a freshly
+// built single-layer manifest referencing them.
+func writeOCILayout(ctx context.Context, imgRef containersTypes.ImageReference, rootfsDir string, configBytes []byte) error {
+	dest, err := imgRef.NewImageDestination(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("while opening image destination: %v", err)
+	}
+	defer dest.Close()
+
+	layerPath, layerDigest, diffID, layerSize, err := tarGzDir(rootfsDir)
+	if err != nil {
+		return fmt.Errorf("while packing rootfs layer: %v", err)
+	}
+	defer os.Remove(layerPath)
+
+	layerFile, err := os.Open(layerPath)
+	if err != nil {
+		return fmt.Errorf("while opening rootfs layer: %v", err)
+	}
+	defer layerFile.Close()
+
+	if _, err := dest.PutBlob(ctx, layerFile, containersTypes.BlobInfo{
+		Digest: layerDigest,
+		Size:   layerSize,
+	}, none.NoCache, false); err != nil {
+		return fmt.Errorf("while uploading rootfs layer: %v", err)
+	}
+
+	configBytes, err = rewriteConfigForSingleLayer(configBytes, diffID)
+	if err != nil {
+		return fmt.Errorf("while rewriting image config for merged layer: %v", err)
+	}
+
+	configDigest := digest.FromBytes(configBytes)
+	if _, err := dest.PutBlob(ctx, bytes.NewReader(configBytes), containersTypes.BlobInfo{
+		Digest: configDigest,
+		Size:   int64(len(configBytes)),
+	}, none.NoCache, true); err != nil {
+		return fmt.Errorf("while uploading image config: %v", err)
+	}
+
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.manifest.v1+json",
+		Config: ociDescriptor{
+			MediaType: "application/vnd.oci.image.config.v1+json",
+			Digest:    configDigest.String(),
+			Size:      int64(len(configBytes)),
+		},
+		Layers: []ociDescriptor{{
+			MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+			Digest:    layerDigest.String(),
+			Size:      layerSize,
+		}},
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("while marshaling manifest: %v", err)
+	}
+
+	if err := dest.PutManifest(ctx, manifestBytes, nil); err != nil {
+		return fmt.Errorf("while uploading manifest: %v", err)
+	}
+
+	return dest.Commit(ctx, nil)
+}
+
+// ociRootfs and ociHistoryEntry mirror the OCI image-spec config fields that
+// rewriteConfigForSingleLayer needs to replace; every other field of the
+// config is passed through untouched via json.RawMessage.
+type ociRootfs struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type ociHistoryEntry struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// rewriteConfigForSingleLayer replaces configBytes's "rootfs" and "history"
+// fields so they describe the single merged layer identified by diffID,
+// instead of the source image's original layer set. ToOCI re-tars every
+// layer of the source image into one, so the original config's diff_ids
+// (and the history entries accounting for them) no longer match what the
+// manifest actually references; an OCI consumer that checks
+// len(diff_ids) == len(manifest.layers), or compares diffIDs against layer
+// content, would otherwise reject the image for any source with more than
+// one layer.
+func rewriteConfigForSingleLayer(configBytes []byte, diffID digest.Digest) ([]byte, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(configBytes, &raw); err != nil {
+		return nil, fmt.Errorf("while parsing image config: %v", err)
+	}
+
+	rootfs := ociRootfs{
+		Type:    "layers",
+		DiffIDs: []string{diffID.String()},
+	}
+	rootfsBytes, err := json.Marshal(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	raw["rootfs"] = rootfsBytes
+
+	history := []ociHistoryEntry{{
+		CreatedBy: "singularity oci2sif: merged source image layers into one",
+	}}
+	historyBytes, err := json.Marshal(history)
+	if err != nil {
+		return nil, err
+	}
+	raw["history"] = historyBytes
+
+	return json.Marshal(raw)
+}
+
+// tarGzDir packs dir as a gzip-compressed tar to a new temporary file, and
+// returns its path, the digest of the compressed content (the layer
+// digest), the digest of the uncompressed tar (the diffID, used in the OCI
+// config's rootfs.diff_ids — see writeOCILayout), and the compressed size.
+func tarGzDir(dir string) (string, digest.Digest, digest.Digest, int64, error) {
+	f, err := ioutil.TempFile("", "oci-sif-layer-")
+	if err != nil {
+		return "", "", "", 0, err
+	}
+
+	layerDigester := digest.Canonical.Digester()
+	diffDigester := digest.Canonical.Digester()
+	gw := gzip.NewWriter(io.MultiWriter(f, layerDigester.Hash()))
+	tw := tar.NewWriter(io.MultiWriter(gw, diffDigester.Hash()))
+
+	walkErr := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			fp, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer fp.Close()
+			_, err = io.Copy(tw, fp)
+			return err
+		}
+		return nil
+	})
+
+	twErr := tw.Close()
+	gwErr := gw.Close()
+	fi, statErr := f.Stat()
+	closeErr := f.Close()
+
+	for _, err := range []error{walkErr, twErr, gwErr, statErr, closeErr} {
+		if err != nil {
+			os.Remove(f.Name())
+			return "", "", "", 0, err
+		}
+	}
+
+	return f.Name(), layerDigester.Digest(), diffDigester.Digest(), fi.Size(), nil
+}
+
+// findJSONDescriptor returns the raw bytes of the DataGenericJSON descriptor
+// named name within fimg.
+func findJSONDescriptor(fimg *sif.FileImage, name string) []byte {
+	for _, d := range fimg.DescrArr {
+		if !d.Used || d.Datatype != sif.DataGenericJSON {
+			continue
+		}
+		if d.GetName() == name {
+			data, err := ioutil.ReadAll(d.GetReader(fimg))
+			if err != nil {
+				return nil
+			}
+			return data
+		}
+	}
+	return nil
+}
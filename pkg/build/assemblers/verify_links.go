@@ -0,0 +1,70 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package assemblers
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hpcng/sif/pkg/sif"
+)
+
+// verifyLinkedPairs reloads the just-written SIF at path and confirms that
+// its linkType descriptors actually link to the targetType descriptors they
+// were built for.
+//
+// CreateContainer assigns descriptor IDs sequentially, starting at 1, in the
+// order its InputDescr slice was populated — so a descriptor appended
+// immediately after the one it links to can have that ID predicted as
+// uint32(len(cinfo.InputDescr)) before the container exists on disk, which is
+// what createFatSIF/createSIF (in this package) both do. That prediction is
+// exactly what this reloads the file and checks, by pairing up the two
+// descriptor types in ascending-ID (creation) order: unlike
+// crypt/sif_encryptor.go, which patches an *existing* container and so
+// reads the real ID back with GetPartPrimSys because it has no other way to
+// know it, callers here build the whole container in one CreateContainer
+// call and don't strictly need to re-derive it — but verifying catches a
+// library-behavior mismatch before it produces a silently corrupt SIF.
+func verifyLinkedPairs(path string, targetType, linkType sif.Datatype) error {
+	fimg, err := sif.LoadContainer(path, true)
+	if err != nil {
+		return fmt.Errorf("while loading SIF to verify descriptor links: %w", err)
+	}
+	defer fimg.UnloadContainer()
+
+	var targets, links []*sif.Descriptor
+	for i := range fimg.DescrArr {
+		d := &fimg.DescrArr[i]
+		if !d.Used {
+			continue
+		}
+		switch d.Datatype {
+		case targetType:
+			targets = append(targets, d)
+		case linkType:
+			links = append(links, d)
+		}
+	}
+
+	if len(links) == 0 {
+		return nil
+	}
+
+	sort.Slice(targets, func(i, j int) bool { return targets[i].ID < targets[j].ID })
+	sort.Slice(links, func(i, j int) bool { return links[i].ID < links[j].ID })
+
+	if len(links) != len(targets) {
+		return fmt.Errorf("found %d linking descriptors but %d link targets, expected a 1:1 pairing", len(links), len(targets))
+	}
+
+	for i := range links {
+		if links[i].Link != uint32(targets[i].ID) {
+			return fmt.Errorf("descriptor %d links to ID %d, want %d (the descriptor it was built for)", links[i].ID, links[i].Link, targets[i].ID)
+		}
+	}
+
+	return nil
+}
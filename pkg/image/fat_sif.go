@@ -0,0 +1,53 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package image
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/hpcng/sif/pkg/sif"
+)
+
+// SelectArchPartition returns the primary system partition descriptor of
+// fimg matching runtime.GOARCH. If fimg has no partition for the running
+// architecture, the entries in prefs are tried in order. An error is
+// returned if none of them match either, so that a fat SIF built without the
+// running (or a preferred) architecture fails fast instead of silently
+// running the wrong code.
+func SelectArchPartition(fimg *sif.FileImage, prefs []string) (*sif.Descriptor, error) {
+	if descr, err := findArchPartition(fimg, runtime.GOARCH); err == nil {
+		return descr, nil
+	}
+
+	for _, arch := range prefs {
+		if descr, err := findArchPartition(fimg, arch); err == nil {
+			return descr, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no primary system partition found for architecture %s", runtime.GOARCH)
+}
+
+func findArchPartition(fimg *sif.FileImage, arch string) (*sif.Descriptor, error) {
+	sifArch := sif.GetSIFArch(arch)
+
+	for _, descr := range fimg.DescrArr {
+		if !descr.Used || descr.Datatype != sif.DataPartition {
+			continue
+		}
+
+		if descr.Parttype != sif.PartPrimSys {
+			continue
+		}
+		if descr.GetArch() == sifArch {
+			d := descr
+			return &d, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no partition found for architecture %s", arch)
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2018-2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package packer
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hpcng/singularity/pkg/sylog"
+)
+
+// Compression identifies a squashfs compression codec.
+type Compression int
+
+const (
+	// CompressionGzip is the squashfs-tools default codec.
+	CompressionGzip Compression = iota
+	// CompressionZstd trades a little ratio for much faster decompression.
+	CompressionZstd
+	// CompressionLz4 favors decompression speed over ratio.
+	CompressionLz4
+	// CompressionXz favors ratio over speed.
+	CompressionXz
+	// CompressionNone disables squashfs compression entirely.
+	CompressionNone
+)
+
+// String returns the mksquashfs -comp codec name for c.
+func (c Compression) String() string {
+	switch c {
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionLz4:
+		return "lz4"
+	case CompressionXz:
+		return "xz"
+	case CompressionNone:
+		return "none"
+	default:
+		return "unknown"
+	}
+}
+
+// Squashfs packs a list of directories/files into a squashfs filesystem
+// using the mksquashfs binary.
+type Squashfs struct {
+	MksquashfsPath string
+}
+
+// NewSquashfs returns a Squashfs packer.
+func NewSquashfs() *Squashfs {
+	return &Squashfs{}
+}
+
+func (s *Squashfs) mksquashfsPath() string {
+	if s.MksquashfsPath != "" {
+		return s.MksquashfsPath
+	}
+
+	return "mksquashfs"
+}
+
+// Create calls mksquashfs to create a squashfs filesystem from files into
+// dest, passing through opts as additional mksquashfs arguments.
+func (s *Squashfs) Create(files []string, dest string, opts []string) error {
+	args := append(files, dest)
+	args = append(args, opts...)
+
+	cmd := exec.Command(s.mksquashfsPath(), args...)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("while running mksquashfs: %v: %s", err, out)
+	}
+
+	return nil
+}
+
+// CompressionArgs translates a compression codec, level and block size into
+// the mksquashfs arguments that select them. level and blockSize of zero are
+// omitted, letting mksquashfs fall back to its own defaults.
+func (s *Squashfs) CompressionArgs(c Compression, level int, blockSize uint) ([]string, error) {
+	if c == CompressionNone {
+		return []string{"-noI", "-noD", "-noF", "-noX"}, nil
+	}
+
+	args := []string{"-comp", c.String()}
+
+	if level != 0 {
+		switch c {
+		case CompressionZstd, CompressionXz:
+			args = append(args, "-Xcompression-level", strconv.Itoa(level))
+		case CompressionGzip:
+			args = append(args, "-Xcompression-level", strconv.Itoa(level))
+		default:
+			return nil, fmt.Errorf("compression level is not supported for %s", c)
+		}
+	}
+
+	if blockSize != 0 {
+		args = append(args, "-b", fmt.Sprintf("%dK", blockSize))
+	}
+
+	return args, nil
+}
+
+// compressorsHeading marks the start of the "Compressors available" section
+// of mksquashfs's no-argument usage banner, the only place squashfs-tools
+// reports which codecs a given binary was built with ("-version" only prints
+// a version/copyright banner, not the compressor list).
+const compressorsHeading = "Compressors available"
+
+// ProbeCompression runs mksquashfs with no arguments and fails fast if c was
+// not compiled into the available mksquashfs binary.
+func (s *Squashfs) ProbeCompression(c Compression) error {
+	if c == CompressionGzip || c == CompressionNone {
+		// Always available: gzip is the mandatory baseline codec and "none"
+		// requires no codec support at all.
+		return nil
+	}
+
+	cmd := exec.Command(s.mksquashfsPath())
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	// mksquashfs with no arguments prints its usage banner and exits
+	// non-zero, so the error here is expected and only the output matters.
+	if err := cmd.Run(); err != nil {
+		sylog.Debugf("mksquashfs usage banner returned: %v", err)
+	}
+
+	idx := strings.Index(out.String(), compressorsHeading)
+	if idx == -1 {
+		return fmt.Errorf("unable to determine mksquashfs compressor support: no %q section in usage output", compressorsHeading)
+	}
+
+	codec := regexp.MustCompile(`(?mi)^\s*` + regexp.QuoteMeta(c.String()) + `\b`)
+	if !codec.MatchString(out.String()[idx:]) {
+		return fmt.Errorf("mksquashfs was not compiled with %s compression support", c)
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package unpacker extracts squashfs partitions to a sandbox directory
+// without shelling out to unsquashfs. It is the read side of pkg/image/packer,
+// and exists to close off CVE-2020-15229 (path traversal via a crafted
+// squashfs) and CVE-2020-25039/25040 (world-readable extraction sandbox):
+// every entry is validated to stay within the destination root before it is
+// written, and the destination is kept 0700 until extraction completes.
+package unpacker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/CalebQ42/squashfs"
+)
+
+// Options controls SafeExtractor behavior.
+type Options struct {
+	// AllowDevices permits extracting device and FIFO nodes. They are
+	// skipped by default, since a sandbox build has no legitimate use for
+	// them and a crafted image can use them to access host devices.
+	AllowDevices bool
+}
+
+// SafeExtractor extracts a squashfs file to a destination directory,
+// rejecting any entry that would escape that directory.
+type SafeExtractor struct {
+	Options Options
+}
+
+// New returns a SafeExtractor configured with opts.
+func New(opts Options) *SafeExtractor {
+	return &SafeExtractor{Options: opts}
+}
+
+// ExtractAll extracts every entry of the squashfs file at squashfsPath into
+// dest, which is created if it does not already exist.
+func (e *SafeExtractor) ExtractAll(squashfsPath, dest string) error {
+	f, err := os.Open(squashfsPath)
+	if err != nil {
+		return fmt.Errorf("while opening squashfs file: %s", err)
+	}
+	defer f.Close()
+
+	r, err := squashfs.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("while reading squashfs file: %s", err)
+	}
+
+	root, err := filepath.Abs(dest)
+	if err != nil {
+		return fmt.Errorf("while resolving destination: %s", err)
+	}
+
+	// Created 0700 and only relaxed once every entry has landed safely, so
+	// a build that's interrupted mid-extraction never leaves a
+	// world-readable sandbox behind.
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return fmt.Errorf("while creating destination: %s", err)
+	}
+
+	if err := e.extractEntry(r.Root, root, root); err != nil {
+		return err
+	}
+
+	return os.Chmod(root, 0o755)
+}
+
+// extractEntry recursively extracts entry and its children under the
+// directory parent, which must already have been validated to be within
+// root.
+func (e *SafeExtractor) extractEntry(entry *squashfs.File, parent, root string) error {
+	for _, child := range entry.GetChildren() {
+		destPath, err := safeJoin(root, parent, child.Name())
+		if err != nil {
+			return fmt.Errorf("while resolving %s: %s", child.Name(), err)
+		}
+
+		switch {
+		case child.IsDir():
+			// Created 0700 regardless of the entry's real mode, then
+			// chmod'd to it once every child has landed, for the same
+			// reason ExtractAll holds root at 0700 until extraction
+			// completes: a mode restored up front could make an
+			// in-progress directory traversable or writable before its
+			// contents are actually safe to expose.
+			if err := os.Mkdir(destPath, 0o700); err != nil && !os.IsExist(err) {
+				return fmt.Errorf("while creating directory %s: %s", destPath, err)
+			}
+			if err := e.extractEntry(child, destPath, root); err != nil {
+				return err
+			}
+			if err := os.Chmod(destPath, child.Mode().Perm()); err != nil {
+				return fmt.Errorf("while restoring mode of %s: %s", destPath, err)
+			}
+		case child.IsSymlink():
+			if err := e.extractSymlink(child, destPath, root); err != nil {
+				return err
+			}
+		case child.IsHardlink():
+			if err := e.extractHardlink(child, destPath, root); err != nil {
+				return err
+			}
+		case child.IsRegular():
+			if err := extractRegular(child, destPath); err != nil {
+				return err
+			}
+		default:
+			if !e.Options.AllowDevices {
+				continue
+			}
+			if err := extractDevice(child, destPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// extractSymlink validates that a symlink's target, resolved relative to its
+// own location, stays within root before creating it. This catches both
+// relative traversal ("../../etc/passwd") and absolute targets that would
+// otherwise point outside the sandbox once combined with a chroot-less
+// extraction. The link written to disk is always the *validated* target,
+// rewritten relative to destPath's directory, never the raw entry value —
+// otherwise an absolute target with no ".." component (e.g. "/etc/passwd")
+// would pass containment but still be written verbatim, escaping root the
+// moment anything reads through it outside a chroot.
+func (e *SafeExtractor) extractSymlink(entry *squashfs.File, destPath, root string) error {
+	relTarget, err := resolveSymlinkTarget(entry.SymlinkPath(), destPath, root)
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(relTarget, destPath)
+}
+
+// resolveSymlinkTarget re-roots target (a raw, untrusted squashfs symlink
+// target) under root if absolute, or against destPath's directory if
+// relative, validates the result stays within root, and returns it rewritten
+// relative to destPath's directory — the value that must actually be written
+// with os.Symlink. Pulled out of extractSymlink so the containment logic can
+// be fuzzed directly with crafted target/destPath pairs, without needing a
+// real squashfs file to drive it.
+func resolveSymlinkTarget(target, destPath, root string) (string, error) {
+	resolved := target
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(filepath.Dir(destPath), resolved)
+	} else {
+		resolved = filepath.Join(root, resolved)
+	}
+
+	validated, err := safeJoin(root, filepath.Dir(resolved), filepath.Base(resolved))
+	if err != nil {
+		return "", fmt.Errorf("symlink %s -> %s escapes destination: %s", destPath, target, err)
+	}
+
+	relTarget, err := filepath.Rel(filepath.Dir(destPath), validated)
+	if err != nil {
+		return "", fmt.Errorf("while computing symlink target for %s: %s", destPath, err)
+	}
+
+	return relTarget, nil
+}
+
+// extractHardlink validates that a hardlink's target, resolved against root,
+// stays within it before creating the link. A target outside root is
+// rejected outright rather than resolved against the filesystem being
+// extracted into, since that filesystem doesn't exist yet.
+func (e *SafeExtractor) extractHardlink(entry *squashfs.File, destPath, root string) error {
+	target := entry.HardlinkTarget()
+
+	targetPath, err := safeJoin(root, root, strings.TrimPrefix(target, string(filepath.Separator)))
+	if err != nil {
+		return fmt.Errorf("hardlink %s -> %s escapes destination: %s", destPath, target, err)
+	}
+
+	return os.Link(targetPath, destPath)
+}
+
+// extractRegular streams a regular file's content out to destPath.
+func extractRegular(entry *squashfs.File, destPath string) error {
+	rc, err := entry.Reader()
+	if err != nil {
+		return fmt.Errorf("while opening %s: %s", entry.Name(), err)
+	}
+	defer rc.Close()
+
+	out, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.Mode())
+	if err != nil {
+		return fmt.Errorf("while creating %s: %s", destPath, err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, rc); err != nil {
+		return fmt.Errorf("while writing %s: %s", destPath, err)
+	}
+
+	return nil
+}
+
+// extractDevice creates the character, block, or FIFO device node described
+// by entry at destPath via mknod, using entry's device major/minor and mode
+// bits. Only reached when Options.AllowDevices is set.
+func extractDevice(entry *squashfs.File, destPath string) error {
+	mode := entry.Mode()
+	sysMode := uint32(mode.Perm())
+
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		sysMode |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		sysMode |= syscall.S_IFBLK
+	case mode&os.ModeNamedPipe != 0:
+		sysMode |= syscall.S_IFIFO
+	default:
+		return fmt.Errorf("%s is not a device, block device, or FIFO", destPath)
+	}
+
+	if err := syscall.Mknod(destPath, sysMode, int(entry.Rdev())); err != nil {
+		return fmt.Errorf("while creating device node %s: %s", destPath, err)
+	}
+
+	return nil
+}
+
+// safeJoin joins parent and name, and rejects the result unless it resolves
+// to a path within root. Both the syntactic (filepath.Clean) and symbolic
+// (filepath.Rel) forms are checked, since a crafted name can contain ".."
+// components that Clean alone wouldn't catch without this comparison.
+func safeJoin(root, parent, name string) (string, error) {
+	joined := filepath.Clean(filepath.Join(parent, name))
+
+	rel, err := filepath.Rel(root, joined)
+	if err != nil {
+		return "", fmt.Errorf("invalid path %s: %s", name, err)
+	}
+
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s escapes destination root", name)
+	}
+
+	return joined, nil
+}
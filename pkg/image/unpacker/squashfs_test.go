@@ -0,0 +1,122 @@
+// Copyright (c) 2021, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package unpacker
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSafeJoin(t *testing.T) {
+	root := t.TempDir()
+
+	tests := []struct {
+		name    string
+		parent  string
+		entry   string
+		wantErr bool
+	}{
+		{name: "plain file", parent: root, entry: "file.txt"},
+		{name: "nested dir", parent: filepath.Join(root, "a", "b"), entry: "file.txt"},
+		{name: "dot dot escape", parent: root, entry: "../etc/passwd", wantErr: true},
+		{name: "deep dot dot escape", parent: filepath.Join(root, "a"), entry: "../../../etc/passwd", wantErr: true},
+		{name: "bare dot dot", parent: root, entry: "..", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := safeJoin(root, tt.parent, tt.entry)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("safeJoin(%q, %q) = %q, want error", tt.parent, tt.entry, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("safeJoin(%q, %q) returned unexpected error: %v", tt.parent, tt.entry, err)
+			}
+		})
+	}
+}
+
+// FuzzResolveSymlinkTarget hand-crafts malicious squashfs symlink targets —
+// absolute paths, traversal sequences, and combinations of both — and
+// asserts that the target resolveSymlinkTarget approves, once joined back
+// against destPath's directory, never resolves outside root. This is the
+// exact CVE-2020-15229 vector: a crafted absolute target with no ".."
+// component used to pass containment but still get written to disk
+// verbatim.
+func FuzzResolveSymlinkTarget(f *testing.F) {
+	seeds := []string{
+		"/etc/passwd",
+		"../../etc/passwd",
+		"../../../../etc/shadow",
+		"subdir/../../etc/passwd",
+		"/../etc/passwd",
+		"/./etc/passwd",
+		"....//etc/passwd",
+		"ok.txt",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, target string) {
+		root := t.TempDir()
+		destPath := filepath.Join(root, "link")
+
+		relTarget, err := resolveSymlinkTarget(target, destPath, root)
+		if err != nil {
+			return
+		}
+
+		resolved := filepath.Join(filepath.Dir(destPath), relTarget)
+		rel, err := filepath.Rel(root, resolved)
+		if err != nil {
+			t.Fatalf("resolveSymlinkTarget(%q) = %q which is not relative to root: %v", target, relTarget, err)
+		}
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			t.Fatalf("resolveSymlinkTarget(%q) escaped root: relTarget=%q resolved=%q", target, relTarget, resolved)
+		}
+	})
+}
+
+// FuzzSafeJoin hand-crafts path-traversal inputs (the same shape a crafted
+// squashfs entry name or symlink target could carry) and asserts safeJoin
+// never returns a path outside root.
+func FuzzSafeJoin(f *testing.F) {
+	seeds := []string{
+		"file.txt",
+		"../etc/passwd",
+		"..",
+		"../../etc/shadow",
+		"ok/../../etc/passwd",
+		"a/b/../../../etc/passwd",
+		"/etc/passwd",
+		"....//....//etc/passwd",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		root := t.TempDir()
+
+		joined, err := safeJoin(root, root, name)
+		if err != nil {
+			return
+		}
+
+		rel, err := filepath.Rel(root, joined)
+		if err != nil {
+			t.Fatalf("safeJoin(%q) = %q which is not relative to root: %v", name, joined, err)
+		}
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			t.Fatalf("safeJoin(%q) escaped root: joined=%q rel=%q", name, joined, rel)
+		}
+	})
+}